@@ -0,0 +1,162 @@
+package bbolt_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/coalescer"
+	. "github.com/boltdb/coalescer/bbolt"
+	"go.etcd.io/bbolt"
+)
+
+// Ensure that the coalescer groups together multiple updates against a
+// *bbolt.DB, using the native func(*bbolt.Tx) error handler signature
+// called directly on the Coalescer returned by New(), with no call-site
+// changes required beyond the constructor.
+func TestCoalescer_Update(t *testing.T) {
+	db := open()
+	defer closedb(db)
+	c, err := New(db, 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	go func() {
+		err := c.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("foo"))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("coalesce update(1) failed: %s", err)
+		}
+	}()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		err := c.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("foo")).Put([]byte("bar"), []byte("baz"))
+		})
+		if err != nil {
+			t.Fatalf("coalesce update(2) failed: %s", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("foo"))
+		if b == nil {
+			t.Error("bucket not created")
+		} else if v := b.Get([]byte("bar")); string(v) != "baz" {
+			t.Errorf("invalid value: %#v", v)
+		}
+		return nil
+	})
+}
+
+// Ensure that, with IsolateErrors enabled, a handler that errors only rolls
+// back its own write and every other handler in the group still commits.
+func TestCoalescer_Update_IsolateErrors(t *testing.T) {
+	db := open()
+	defer closedb(db)
+	c, err := NewWithOptions(db, 10, 50*time.Millisecond, coalescer.Options{IsolateErrors: true})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	c.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	errBoom := errors.New("boom")
+
+	const n = 5
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			results <- c.Update(func(tx *bbolt.Tx) error {
+				if i == 2 {
+					return errBoom
+				}
+				return tx.Bucket([]byte("foo")).Put([]byte{byte(i)}, []byte("ok"))
+			})
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-results; err != nil && err != errBoom {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("foo"))
+		for i := 0; i < n; i++ {
+			v := b.Get([]byte{byte(i)})
+			if i == 2 {
+				if v != nil {
+					t.Errorf("expected handler %d to be rolled back", i)
+				}
+				continue
+			}
+			if string(v) != "ok" {
+				t.Errorf("expected handler %d to commit, got %#v", i, v)
+			}
+		}
+		return nil
+	})
+}
+
+// Ensure that the free function Update() works against a bare
+// *coalescer.Coalescer that wasn't constructed via bbolt.New(), restoring
+// the native func(*bbolt.Tx) error handler signature for that case too.
+func TestUpdate_BareCoalescer(t *testing.T) {
+	db := open()
+	defer closedb(db)
+	c, err := coalescer.New(Wrap(db), 10, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	err = Update(c, func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("coalesce update failed: %s", err)
+	}
+}
+
+// open creates a new temporary bbolt database.
+func open() *bbolt.DB {
+	db, err := bbolt.Open(tempfile(), 0600, nil)
+	if err != nil {
+		panic("open: " + err.Error())
+	}
+	return db
+}
+
+// closedb closes and deletes a bbolt database.
+func closedb(db *bbolt.DB) {
+	if db == nil {
+		return
+	}
+	path := db.Path()
+	db.Close()
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+// tempfile returns the path to a non-existent temporary file.
+func tempfile() string {
+	f, _ := ioutil.TempFile("", "coalescer-")
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	return path
+}
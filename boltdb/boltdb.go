@@ -0,0 +1,177 @@
+// Package boltdb adapts github.com/boltdb/bolt to the coalescer.DB
+// interface, so that a *bolt.DB can be used with coalescer.Coalescer.
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/boltdb/coalescer"
+)
+
+// DB adapts a *bolt.DB to the coalescer.DB interface.
+type DB struct {
+	*bolt.DB
+}
+
+// Wrap returns db adapted to the coalescer.DB interface.
+func Wrap(db *bolt.DB) DB {
+	return DB{db}
+}
+
+// Update implements coalescer.DB.
+func (db DB) Update(fn func(coalescer.Tx) error) error {
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		return fn(Tx{tx})
+	})
+}
+
+// Coalescer wraps a *coalescer.Coalescer backed by a *bolt.DB and restores
+// the original func(*bolt.Tx) error handler signature on Update and
+// UpdateContext, so that a caller migrating from the pre-interface
+// coalescer API only has to change its constructor call (coalescer.New ->
+// boltdb.New); every c.Update(fn)/c.UpdateContext(ctx, fn) call site and
+// handler body keeps compiling unchanged. All other methods, such as
+// Close() and Stats(), are promoted unchanged from the embedded Coalescer.
+type Coalescer struct {
+	*coalescer.Coalescer
+}
+
+// New returns a new Coalescer backed by db. The coalescer will
+// automatically flush when the number of transactions reaches limit or
+// after interval has passed.
+func New(db *bolt.DB, limit int, interval time.Duration) (*Coalescer, error) {
+	return NewWithOptions(db, limit, interval, coalescer.Options{})
+}
+
+// NewWithOptions returns a new Coalescer backed by db, as New() does, but
+// allows optional behavior to be configured via opts.
+func NewWithOptions(db *bolt.DB, limit int, interval time.Duration, opts coalescer.Options) (*Coalescer, error) {
+	c, err := coalescer.NewWithOptions(Wrap(db), limit, interval, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Coalescer{c}, nil
+}
+
+// Update executes fn in the context of a write transaction, using the
+// original func(*bolt.Tx) error handler signature. It shadows the embedded
+// coalescer.Coalescer.Update, which takes a func(coalescer.Tx) error.
+func (c *Coalescer) Update(fn func(tx *bolt.Tx) error) error {
+	return c.Coalescer.Update(func(tx coalescer.Tx) error {
+		return fn(tx.(Tx).Tx)
+	})
+}
+
+// UpdateContext is the context-aware counterpart to Update, as
+// coalescer.Coalescer.UpdateContext is, but using the original
+// func(*bolt.Tx) error handler signature.
+func (c *Coalescer) UpdateContext(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	return c.Coalescer.UpdateContext(ctx, func(tx coalescer.Tx) error {
+		return fn(tx.(Tx).Tx)
+	})
+}
+
+// Update executes fn in the context of a coalesced write transaction, using
+// the original func(*bolt.Tx) error handler signature, against a bare
+// *coalescer.Coalescer (e.g. one obtained via coalescer.New(boltdb.Wrap(db),
+// ...) rather than boltdb.New). Most callers should prefer boltdb.New and
+// its Coalescer.Update method, which only requires changing the constructor
+// call; this free function is for coalescer.Coalescer values that didn't
+// come from boltdb.New.
+func Update(c *coalescer.Coalescer, fn func(tx *bolt.Tx) error) error {
+	return c.Update(func(tx coalescer.Tx) error {
+		return fn(tx.(Tx).Tx)
+	})
+}
+
+// Tx adapts a *bolt.Tx to the coalescer.Tx interface.
+type Tx struct {
+	*bolt.Tx
+}
+
+// CreateBucket implements coalescer.Tx.
+func (tx Tx) CreateBucket(name []byte) (coalescer.Bucket, error) {
+	b, err := tx.Tx.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return Bucket{b}, nil
+}
+
+// CreateBucketIfNotExists implements coalescer.Tx.
+func (tx Tx) CreateBucketIfNotExists(name []byte) (coalescer.Bucket, error) {
+	b, err := tx.Tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return Bucket{b}, nil
+}
+
+// Bucket implements coalescer.Tx.
+func (tx Tx) Bucket(name []byte) coalescer.Bucket {
+	b := tx.Tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return Bucket{b}
+}
+
+// ForEach implements coalescer.Tx.
+func (tx Tx) ForEach(fn func(name []byte, b coalescer.Bucket) error) error {
+	return tx.Tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, Bucket{b})
+	})
+}
+
+// Bucket adapts a *bolt.Bucket to the coalescer.Bucket interface. It wraps
+// rather than embeds *bolt.Bucket since the interface requires a Bucket()
+// method of its own.
+type Bucket struct {
+	b *bolt.Bucket
+}
+
+// Get implements coalescer.Bucket.
+func (bk Bucket) Get(key []byte) []byte { return bk.b.Get(key) }
+
+// Put implements coalescer.Bucket.
+func (bk Bucket) Put(key, value []byte) error { return bk.b.Put(key, value) }
+
+// Delete implements coalescer.Bucket.
+func (bk Bucket) Delete(key []byte) error { return bk.b.Delete(key) }
+
+// CreateBucket implements coalescer.Bucket.
+func (bk Bucket) CreateBucket(name []byte) (coalescer.Bucket, error) {
+	nb, err := bk.b.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return Bucket{nb}, nil
+}
+
+// CreateBucketIfNotExists implements coalescer.Bucket.
+func (bk Bucket) CreateBucketIfNotExists(name []byte) (coalescer.Bucket, error) {
+	nb, err := bk.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return Bucket{nb}, nil
+}
+
+// Bucket implements coalescer.Bucket.
+func (bk Bucket) Bucket(name []byte) coalescer.Bucket {
+	nb := bk.b.Bucket(name)
+	if nb == nil {
+		return nil
+	}
+	return Bucket{nb}
+}
+
+// DeleteBucket implements coalescer.Bucket.
+func (bk Bucket) DeleteBucket(name []byte) error { return bk.b.DeleteBucket(name) }
+
+// ForEach implements coalescer.Bucket.
+func (bk Bucket) ForEach(fn func(k, v []byte) error) error {
+	return bk.b.ForEach(fn)
+}
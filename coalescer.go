@@ -1,10 +1,10 @@
 package coalescer
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 var (
@@ -19,28 +19,66 @@ var (
 	// ErrInvalidInterval is returned when the interval passed to New() is
 	// a non-positive duration.
 	ErrInvalidInterval = errors.New("invalid coalescer interval")
+
+	// ErrClosed is returned from Update() and UpdateContext() once the
+	// Coalescer has been closed.
+	ErrClosed = errors.New("coalescer closed")
 )
 
-// Coalescer automatically groups together Bolt write transactions and flushes
-// them together as a single transaction. This approach is useful for increasing
-// write throughput. However, because all transactions are grouped together,
-// rolling back one transaction will roll back all of them.
+// Options configures optional behavior of a Coalescer. The zero value of
+// Options matches the behavior of New().
+type Options struct {
+	// IsolateErrors, when true, prevents a single failing handler from
+	// rolling back the writes of every other handler in its coalescing
+	// group. When a handler returns an error the group is still rolled
+	// back, but the surviving handlers are re-run in a fresh transaction,
+	// skipping the offending handler, until the group commits or every
+	// handler has been isolated.
+	IsolateErrors bool
+
+	// OnFlush, if set, is called after every timer- or limit-triggered
+	// flush with a snapshot of the Coalescer's Stats, e.g. to report
+	// coalescing activity to Prometheus or expvar.
+	OnFlush func(Stats)
+}
+
+// Coalescer automatically groups together write transactions against a DB
+// and flushes them together as a single transaction. This approach is
+// useful for increasing write throughput. However, because all transactions
+// are grouped together, rolling back one transaction will roll back all of
+// them, unless Options.IsolateErrors is enabled.
 type Coalescer struct {
-	db       *bolt.DB
+	stats counters
+
+	db       DB
 	limit    int
 	interval time.Duration
+	opts     Options
 
-	tx       *bolt.Tx
-	handlers chan *handler
-	force    chan bool
-	count    chan bool
+	handlers  chan *handler
+	force     chan bool
+	count     chan bool
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// enqueueMu serializes enqueuing a handler in UpdateContext with
+	// Close's final drain, so a handler can never be enqueued after Close
+	// has already read c.handlers empty for the last time.
+	enqueueMu sync.Mutex
 }
 
-// New returns a new transaction Coalescer for a Bolt database.
+// New returns a new transaction Coalescer for db.
 // The coalescer will automatically flush when the number of transactions
 // reaches the limit or after the interval has passed. If limit or interval
 // is zero then those parameters are ignored.
-func New(db *bolt.DB, limit int, interval time.Duration) (*Coalescer, error) {
+func New(db DB, limit int, interval time.Duration) (*Coalescer, error) {
+	return NewWithOptions(db, limit, interval, Options{})
+}
+
+// NewWithOptions returns a new transaction Coalescer for db, as New() does,
+// but allows optional behavior to be configured via opts.
+func NewWithOptions(db DB, limit int, interval time.Duration, opts Options) (*Coalescer, error) {
 	if limit <= 0 {
 		return nil, ErrInvalidLimit
 	}
@@ -53,11 +91,15 @@ func New(db *bolt.DB, limit int, interval time.Duration) (*Coalescer, error) {
 		db:       db,
 		limit:    limit,
 		interval: interval,
+		opts:     opts,
 		handlers: make(chan *handler, limit),
 		force:    make(chan bool),
 		count:    make(chan bool),
+		done:     make(chan struct{}),
 	}
 
+	c.wg.Add(2)
+
 	// Start a separate goroutine to periodically flush the updates.
 	go c.flusher()
 
@@ -67,32 +109,121 @@ func New(db *bolt.DB, limit int, interval time.Duration) (*Coalescer, error) {
 	return c, nil
 }
 
-// Update executes a function in the context of a write transaction.
-func (c *Coalescer) Update(fn func(tx *bolt.Tx) error) error {
-	c.count <- true
-	h := &handler{fn, make(chan error)}
-	c.handlers <- h
-	return <-h.ch
+// Update executes a function in the context of a write transaction. It
+// blocks until the coalesced group containing fn commits, or the Coalescer
+// is closed.
+func (c *Coalescer) Update(fn func(tx Tx) error) error {
+	return c.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext executes fn in the context of a write transaction, as
+// Update() does, but also returns ctx.Err() if ctx is canceled before fn is
+// enqueued or before its coalesced group flushes. The coalesced transaction
+// itself keeps running even if ctx is canceled; only the caller stops
+// waiting for it.
+func (c *Coalescer) UpdateContext(ctx context.Context, fn func(tx Tx) error) error {
+	start := time.Now()
+	defer func() { c.recordWait(time.Since(start)) }()
+
+	// Buffer the result channel so that flush()/isolate() never blocks
+	// delivering a result to a caller who has already stopped waiting.
+	h := &handler{fn, make(chan error, 1)}
+
+	if err := c.enqueue(ctx, h); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-h.ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue queues h for the next flush. It holds enqueueMu for its entire
+// duration, the same lock Close's final drain holds while it reads
+// c.handlers empty, so the two can never interleave: either h is fully
+// queued before that drain runs and is guaranteed to be seen by it, or the
+// drain has already happened and enqueue observes c.done closed and fails
+// with ErrClosed instead of queuing a handler nothing will ever flush.
+func (c *Coalescer) enqueue(ctx context.Context, h *handler) error {
+	c.enqueueMu.Lock()
+	defer c.enqueueMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.count <- true:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case c.handlers <- h:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// Close stops the Coalescer's background goroutines, flushes any queued
+// handlers into one final transaction, and causes subsequent calls to
+// Update() and UpdateContext() to return ErrClosed. It is safe to call
+// Close more than once.
+func (c *Coalescer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.wg.Wait()
+
+	c.enqueueMu.Lock()
+	defer c.enqueueMu.Unlock()
+	c.drain(flushKindNone)
+	return nil
 }
 
 // Make counter thread safe, by having a single goroutine touch it.
 func (c *Coalescer) counter() {
+	defer c.wg.Done()
 	count := 0
 	for {
-		<-c.count
-		count += 1
-		if count >= c.limit {
-			c.force <- true
-			count = 0
+		select {
+		case <-c.count:
+			count += 1
+			if count >= c.limit {
+				select {
+				case c.force <- true:
+				case <-c.done:
+					return
+				}
+				count = 0
+			}
+		case <-c.done:
+			return
 		}
-
 	}
 }
 
 // flusher continually runs in the background and flushes transactions at
-// given intervals and limits.
+// given intervals and limits, until the Coalescer is closed.
 func (c *Coalescer) flusher() {
+	defer c.wg.Done()
 	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
 		c.flush()
 	}
 }
@@ -101,50 +232,135 @@ func (c *Coalescer) flusher() {
 func (c *Coalescer) flush() {
 	// Wait for a given interval or until the flush is forced because
 	// the number of handlers has exceeded the limit.
+	var kind flushKind
 	select {
 	case <-time.After(c.interval):
+		kind = flushKindTimer
 	case <-c.force:
+		kind = flushKindLimit
+	case <-c.done:
+		return
 	}
 
-	// Ignore flush if we have no queued updates.
+	c.drain(kind)
+}
+
+// drain flushes every handler currently queued in c.handlers into a single
+// transaction. It is used both by flush()'s regular timer/limit cadence and
+// by Close() to deliver any handlers still queued at shutdown, in which case
+// kind is flushKindNone and the flush is not reflected in Stats.
+func (c *Coalescer) drain(kind flushKind) {
+	// Ignore the flush if we have no queued updates.
 	if len(c.handlers) == 0 {
 		return
 	}
 
-	// Iterate over all the handlers
-	var handlers []*handler
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		for {
-			select {
-			case h := <-c.handlers:
-				// Excute handler and return it's error if one occurs.
-				// This will cause a rollback to all previous handlers in
-				// this coalesce group.
-				if err := h.fn(tx); err != nil {
-					h.ch <- err
-					return ErrRollback
-				}
+	// Pull everything currently queued out of the channel before running
+	// any of it. This way, if a handler errors partway through, we know
+	// the full set of handlers that still need to run again: the ones
+	// that already succeeded this attempt, plus every handler that was
+	// queued behind the offender and never even got a chance to run.
+	var queued []*handler
+	for {
+		select {
+		case h := <-c.handlers:
+			queued = append(queued, h)
+			continue
+		default:
+		}
+		break
+	}
 
-				// Track the handler so we can return a rollback if a future
-				// handler returns an error.
-				handlers = append(handlers, h)
-			default:
-				return nil
+	// Stats are recorded before callers are notified, so a caller whose
+	// Update has returned always sees its flush reflected in Stats().
+	committed, survivors, err := c.runBatch(queued)
+	if committed {
+		c.recordFlush(kind, len(survivors), 0)
+		for _, h := range survivors {
+			h.ch <- nil
+		}
+		return
+	}
+
+	// If isolation is enabled, re-run the surviving handlers on their own
+	// so the poison handler only affects itself.
+	if c.opts.IsolateErrors {
+		ok, rollbacks := c.isolate(survivors)
+		c.recordFlush(kind, len(ok), rollbacks+1)
+		for _, h := range ok {
+			h.ch <- nil
+		}
+		return
+	}
+
+	// Notify the rest of the batch of the error. The specific handler that
+	// caused it has already received its own error from runBatch; everyone
+	// else in survivors (those that already succeeded this attempt, plus
+	// those never reached) receives the generic "rollback" error.
+	c.recordFlush(kind, 0, 1)
+	for _, h := range survivors {
+		h.ch <- err
+	}
+}
+
+// runBatch runs handlers, in order, inside a single transaction. If every
+// handler succeeds, committed is true and survivors is the full handler
+// list (none of them have been notified yet). If a handler errors, its own
+// error is delivered to it immediately and the transaction is rolled back;
+// survivors then contains every handler that still needs to run again: the
+// ones that already succeeded this attempt, plus every handler queued
+// behind the offender that runBatch never got to try. If the transaction
+// fails without any handler erroring (e.g. it cannot begin or commit),
+// survivors is the full handler list.
+func (c *Coalescer) runBatch(handlers []*handler) (committed bool, survivors []*handler, err error) {
+	ran := false
+	err = c.db.Update(func(tx Tx) error {
+		ran = true
+		for i, h := range handlers {
+			if err := h.fn(tx); err != nil {
+				h.ch <- err
+				survivors = append(survivors, handlers[i+1:]...)
+				return ErrRollback
 			}
+			survivors = append(survivors, h)
 		}
+		return nil
 	})
+	if err != nil && !ran {
+		survivors = handlers
+	}
+	return err == nil, survivors, err
+}
 
-	// Notify all handlers of an error, if one occurred.
-	// If a handler causes an error then that specific handler will return its
-	// error but all previous handlers will receive a generic "rollback" error.
-	for _, h := range handlers {
-		h.ch <- err
+// isolate re-runs handlers in fresh transactions, one attempt at a time,
+// until the group commits or every handler has caused its own rollback.
+// Each attempt that fails because of a handler removes that handler; an
+// attempt that fails without any handler erroring delivers the
+// transaction's error to every remaining handler and ends the loop. So this
+// always terminates without needing a separate attempt bound. It returns
+// the handlers that ultimately committed, which have not been notified yet,
+// and the number of handler-caused rollbacks it took to get there.
+func (c *Coalescer) isolate(handlers []*handler) (committed []*handler, rollbacks uint64) {
+	for len(handlers) > 0 {
+		ok, survivors, err := c.runBatch(handlers)
+		if ok {
+			return survivors, rollbacks
+		}
+		if len(survivors) == len(handlers) {
+			for _, h := range survivors {
+				h.ch <- err
+			}
+			return nil, rollbacks
+		}
+		rollbacks++
+		handlers = survivors
 	}
+	return nil, rollbacks
 }
 
 // handler represents a handler for update functions and a channel to receive
 // any resulting errors that occur during a coalesced update.
 type handler struct {
-	fn func(*bolt.Tx) error
+	fn func(Tx) error
 	ch chan error
 }
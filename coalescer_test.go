@@ -1,27 +1,26 @@
 package coalescer_test
 
 import (
-	"io/ioutil"
-	"os"
+	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/boltdb/bolt"
 	. "github.com/boltdb/coalescer"
 )
 
 // Ensure that the coalescer groups together multiple updates.
 func TestCoalescer_Update(t *testing.T) {
-	db := open()
-	defer closedb(db)
+	db := newMemDB()
 	c, err := New(db, 10, 50*time.Millisecond)
 	if err != nil {
-		t.Fatalf("new: ", err)
+		t.Fatalf("new: %s", err)
 	}
 
 	// Create a bucket.
 	go func() {
-		err := c.Update(func(tx *bolt.Tx) error {
+		err := c.Update(func(tx Tx) error {
 			_, err := tx.CreateBucket([]byte("foo"))
 			return err
 		})
@@ -33,7 +32,7 @@ func TestCoalescer_Update(t *testing.T) {
 	// Create a key/value in our bucket.
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		err := c.Update(func(tx *bolt.Tx) error {
+		err := c.Update(func(tx Tx) error {
 			return tx.Bucket([]byte("foo")).Put([]byte("bar"), []byte("baz"))
 		})
 		if err != nil {
@@ -43,43 +42,459 @@ func TestCoalescer_Update(t *testing.T) {
 
 	// Verify that our bucket was created.
 	time.Sleep(100 * time.Millisecond)
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("foo"))
-		if b == nil {
-			t.Error("bucket not created")
-		} else if v := b.Get([]byte("bar")); string(v) != "baz" {
-			t.Errorf("invalid value: %#v", v)
+	b := db.bucket("foo")
+	if b == nil {
+		t.Error("bucket not created")
+	} else if v := string(b.m["bar"]); v != "baz" {
+		t.Errorf("invalid value: %#v", v)
+	}
+}
+
+// Ensure that, with IsolateErrors enabled, a handler that errors only rolls
+// back its own write and every other handler in the group still commits.
+func TestCoalescer_Update_IsolateErrors(t *testing.T) {
+	db := newMemDB()
+	c, err := NewWithOptions(db, 10, 50*time.Millisecond, Options{IsolateErrors: true})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	db.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	errBoom := errors.New("boom")
+
+	const n = 5
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			results <- c.Update(func(tx Tx) error {
+				if i == 2 {
+					return errBoom
+				}
+				return tx.Bucket([]byte("foo")).Put([]byte{byte(i)}, []byte("ok"))
+			})
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-results; err != nil && err != errBoom {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	b := db.bucket("foo")
+	for i := 0; i < n; i++ {
+		v := b.m[string([]byte{byte(i)})]
+		if i == 2 {
+			if v != nil {
+				t.Errorf("expected handler %d to be rolled back", i)
+			}
+			continue
+		}
+		if string(v) != "ok" {
+			t.Errorf("expected handler %d to commit, got %#v", i, v)
+		}
+	}
+}
+
+// Ensure that IsolateErrors isolates a poison handler even when it has
+// handlers queued behind it in the same flush, rather than only ever
+// isolating handlers that already succeeded once. The flush is forced by
+// the limit, with a long timer interval, so a later unrelated flush can't
+// mask a handler that was silently dropped instead of isolated.
+func TestCoalescer_Update_IsolateErrors_PoisonNotLast(t *testing.T) {
+	db := newMemDB()
+	c, err := NewWithOptions(db, 3, time.Hour, Options{IsolateErrors: true})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer c.Close()
+
+	db.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	errBoom := errors.New("boom")
+	results := make(chan error, 3)
+
+	// Submit the poison handler first, and give it time to be enqueued,
+	// so that handlers 1 and 2 land behind it in the same flush batch.
+	go func() {
+		results <- c.Update(func(tx Tx) error {
+			return errBoom
+		})
+	}()
+	time.Sleep(5 * time.Millisecond)
+	for _, i := range []int{1, 2} {
+		i := i
+		go func() {
+			results <- c.Update(func(tx Tx) error {
+				return tx.Bucket([]byte("foo")).Put([]byte{byte(i)}, []byte("ok"))
+			})
+		}()
+	}
+
+	timeout := time.After(time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-results:
+			if err != nil && err != errBoom {
+				t.Errorf("unexpected error: %s", err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for updates; a handler queued behind the poison handler likely hung")
+		}
+	}
+
+	b := db.bucket("foo")
+	for _, i := range []int{1, 2} {
+		if string(b.m[string([]byte{byte(i)})]) != "ok" {
+			t.Errorf("handler %d did not commit", i)
+		}
+	}
+
+	if flushes := c.Stats().Flushes; flushes != 1 {
+		t.Errorf("expected all handlers to resolve within a single flush, got %d flushes", flushes)
+	}
+}
+
+// Ensure that isolate() retries the whole surviving batch, not just up to
+// however many poison handlers happened to precede the first successful
+// retry attempt. Queues several poison handlers ahead of one good handler
+// in the same flush, so isolate() must make multiple attempts before it
+// ever reaches the good handler.
+func TestCoalescer_Update_IsolateErrors_MultiplePoison(t *testing.T) {
+	db := newMemDB()
+	c, err := NewWithOptions(db, 4, time.Hour, Options{IsolateErrors: true})
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer c.Close()
+
+	db.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	errBoom := errors.New("boom")
+	results := make(chan error, 4)
+
+	// Submit three poison handlers first, with enough of a head start that
+	// they're enqueued ahead of the one good handler in the same batch.
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- c.Update(func(tx Tx) error {
+				return errBoom
+			})
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	go func() {
+		results <- c.Update(func(tx Tx) error {
+			return tx.Bucket([]byte("foo")).Put([]byte("good"), []byte("ok"))
+		})
+	}()
+
+	timeout := time.After(time.Second)
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-results:
+			if err != nil && err != errBoom {
+				t.Errorf("unexpected error: %s", err)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for updates; isolate() likely stopped retrying before reaching the good handler")
+		}
+	}
+
+	b := db.bucket("foo")
+	if string(b.m["good"]) != "ok" {
+		t.Error("good handler did not commit")
+	}
+}
+
+// Ensure that every update submitted under load has committed by the time
+// Close() returns, and that Close() rejects updates submitted afterward.
+func TestCoalescer_Close(t *testing.T) {
+	db := newMemDB()
+	c, err := New(db, 10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	const n = 20
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Update(func(tx Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("foo"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte{byte(i)}, []byte("ok"))
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("update %d failed: %s", i, err)
+		}
+	}
+
+	b := db.bucket("foo")
+	for i := 0; i < n; i++ {
+		if string(b.m[string([]byte{byte(i)})]) != "ok" {
+			t.Errorf("update %d was not committed before close", i)
+		}
+	}
+
+	if err := c.Update(func(tx Tx) error { return nil }); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// Ensure that Close() never abandons a handler that's concurrently being
+// enqueued by Update(): unlike TestCoalescer_Close, this starts Close()
+// while updates may still be in flight, rather than waiting for them all
+// to finish first, so it actually exercises the race between enqueuing a
+// handler and Close's final drain reading c.handlers empty.
+func TestCoalescer_Close_ConcurrentUpdates(t *testing.T) {
+	db := newMemDB()
+	c, err := New(db, 5, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	db.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	const n = 8
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Update(func(tx Tx) error {
+				return tx.Bucket([]byte("foo")).Put([]byte{byte(i)}, []byte("ok"))
+			})
+		}(i)
+	}
+
+	// No wg.Wait() here: Close() races the still-running Update() calls.
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Update() calls did not return after Close(); a handler enqueued concurrently with Close's drain was likely lost")
+	}
+
+	for i, err := range errs {
+		if err != nil && err != ErrClosed {
+			t.Errorf("update %d returned unexpected error: %s", i, err)
 		}
+	}
+}
+
+// Ensure that UpdateContext returns as soon as its context is canceled,
+// without waiting for the handler's coalescing group to flush.
+func TestCoalescer_UpdateContext_Cancel(t *testing.T) {
+	db := newMemDB()
+	c, err := New(db, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = c.UpdateContext(ctx, func(tx Tx) error {
 		return nil
 	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
 }
 
-// open creates a new temporary Bolt database.
-func open() *bolt.DB {
-	db, err := bolt.Open(tempfile(), 0600)
+// Ensure that Stats() reports monotonically increasing counters and that
+// TimerFlushes + LimitFlushes always equals Flushes.
+func TestCoalescer_Stats(t *testing.T) {
+	db := newMemDB()
+
+	var mu sync.Mutex
+	var onFlushCalls int
+	c, err := NewWithOptions(db, 5, 10*time.Millisecond, Options{
+		OnFlush: func(s Stats) {
+			mu.Lock()
+			onFlushCalls++
+			mu.Unlock()
+		},
+	})
 	if err != nil {
-		panic("open: " + err.Error())
+		t.Fatalf("new: %s", err)
+	}
+	defer c.Close()
+
+	db.Update(func(tx Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	var prev Stats
+	for i := 0; i < 12; i++ {
+		if err := c.Update(func(tx Tx) error {
+			return tx.Bucket([]byte("foo")).Put([]byte{byte(i)}, []byte("ok"))
+		}); err != nil {
+			t.Fatalf("update %d failed: %s", i, err)
+		}
+
+		s := c.Stats()
+		if s.Flushes != s.TimerFlushes+s.LimitFlushes {
+			t.Errorf("Flushes (%d) != TimerFlushes (%d) + LimitFlushes (%d)", s.Flushes, s.TimerFlushes, s.LimitFlushes)
+		}
+		if s.Flushes < prev.Flushes || s.HandlersCoalesced < prev.HandlersCoalesced {
+			t.Errorf("stats are not monotonic: prev=%+v, cur=%+v", prev, s)
+		}
+		prev = s
+	}
+
+	if prev.Flushes == 0 {
+		t.Error("expected at least one flush")
+	}
+	if prev.HandlersCoalesced == 0 {
+		t.Error("expected at least one coalesced handler")
+	}
+
+	mu.Lock()
+	calls := onFlushCalls
+	mu.Unlock()
+	if uint64(calls) != prev.Flushes {
+		t.Errorf("OnFlush called %d times, expected %d", calls, prev.Flushes)
+	}
+}
+
+// memDB is a minimal in-memory implementation of coalescer.DB/Tx/Bucket used
+// to exercise Coalescer without depending on a concrete backing store.
+type memDB struct {
+	mu      sync.Mutex
+	buckets map[string]*memBucket
+}
+
+func newMemDB() *memDB {
+	return &memDB{buckets: make(map[string]*memBucket)}
+}
+
+func (db *memDB) bucket(name string) *memBucket {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.buckets[name]
+}
+
+func (db *memDB) Update(fn func(Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return fn(memTx{db})
+}
+
+type memTx struct {
+	db *memDB
+}
+
+func (tx memTx) CreateBucket(name []byte) (Bucket, error) {
+	b := &memBucket{m: make(map[string][]byte)}
+	tx.db.buckets[string(name)] = b
+	return b, nil
+}
+
+func (tx memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b, ok := tx.db.buckets[string(name)]; ok {
+		return b, nil
 	}
-	return db
+	return tx.CreateBucket(name)
 }
 
-// closedb closes and deletes a ReportifyDB database.
-func closedb(db *bolt.DB) {
-	if db == nil {
-		return
+func (tx memTx) Bucket(name []byte) Bucket {
+	b, ok := tx.db.buckets[string(name)]
+	if !ok {
+		return nil
 	}
-	path := db.Path()
-	db.Close()
-	if path != "" {
-		os.Remove(path)
+	return b
+}
+
+func (tx memTx) DeleteBucket(name []byte) error {
+	delete(tx.db.buckets, string(name))
+	return nil
+}
+
+func (tx memTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	for name, b := range tx.db.buckets {
+		if err := fn([]byte(name), b); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+type memBucket struct {
+	m map[string][]byte
+}
+
+func (b *memBucket) Get(key []byte) []byte { return b.m[string(key)] }
+
+func (b *memBucket) Put(key, value []byte) error {
+	b.m[string(key)] = value
+	return nil
+}
+
+func (b *memBucket) Delete(key []byte) error {
+	delete(b.m, string(key))
+	return nil
+}
+
+func (b *memBucket) CreateBucket(name []byte) (Bucket, error) {
+	return nil, errors.New("memBucket: nested buckets not supported")
+}
+
+func (b *memBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return nil, errors.New("memBucket: nested buckets not supported")
 }
 
-// tempfile returns the path to a non-existent temporary file.
-func tempfile() string {
-	f, _ := ioutil.TempFile("", "coalescer-")
-	path := f.Name()
-	f.Close()
-	os.Remove(path)
-	return path
+func (b *memBucket) Bucket(name []byte) Bucket { return nil }
+
+func (b *memBucket) DeleteBucket(name []byte) error {
+	return errors.New("memBucket: nested buckets not supported")
+}
+
+func (b *memBucket) ForEach(fn func(k, v []byte) error) error {
+	for k, v := range b.m {
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,130 @@
+package coalescer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Coalescer's coalescing activity, as returned by
+// Stats().
+type Stats struct {
+	// Flushes is the total number of timer- or limit-triggered flushes.
+	// Flushes always equals TimerFlushes + LimitFlushes.
+	Flushes uint64
+
+	// TimerFlushes is the number of flushes triggered by interval elapsing.
+	TimerFlushes uint64
+
+	// LimitFlushes is the number of flushes triggered by the handler count
+	// reaching limit.
+	LimitFlushes uint64
+
+	// HandlersCoalesced is the total number of handlers that have
+	// successfully committed across all flushes.
+	HandlersCoalesced uint64
+
+	// Rollbacks is the total number of transactions rolled back because a
+	// handler returned an error, including isolate() retry attempts.
+	Rollbacks uint64
+
+	// LastBatchSize is the number of handlers that committed in the most
+	// recent flush.
+	LastBatchSize int
+
+	// MeanBatchSize is the average number of handlers committed per flush.
+	MeanBatchSize float64
+
+	// MeanWaitNanos is the average time, in nanoseconds, that a call to
+	// Update() or UpdateContext() waits for its result.
+	MeanWaitNanos int64
+}
+
+// flushKind records what triggered a flush, for TimerFlushes/LimitFlushes
+// bookkeeping. A flush with no trigger (e.g. the final drain on Close) is
+// not reflected in Stats.
+type flushKind int
+
+const (
+	flushKindNone flushKind = iota
+	flushKindTimer
+	flushKindLimit
+)
+
+// counters holds the atomically-updated fields backing Stats. It is kept as
+// its own struct, and as the first field of Coalescer, so that its 64-bit
+// fields stay 64-bit aligned for atomic access on 32-bit platforms.
+type counters struct {
+	flushes           uint64
+	timerFlushes      uint64
+	limitFlushes      uint64
+	handlersCoalesced uint64
+	rollbacks         uint64
+	lastBatchSize     int64
+	totalBatchSize    int64
+	totalWaitNanos    int64
+	waitSamples       int64
+}
+
+// Stats returns a snapshot of the Coalescer's coalescing activity.
+func (c *Coalescer) Stats() Stats {
+	// Flushes is derived from the two per-trigger counters so that a
+	// snapshot taken during recordFlush still satisfies the invariant.
+	timerFlushes := atomic.LoadUint64(&c.stats.timerFlushes)
+	limitFlushes := atomic.LoadUint64(&c.stats.limitFlushes)
+	flushes := timerFlushes + limitFlushes
+
+	var meanBatchSize float64
+	if flushes > 0 {
+		totalBatchSize := atomic.LoadInt64(&c.stats.totalBatchSize)
+		meanBatchSize = float64(totalBatchSize) / float64(flushes)
+	}
+
+	var meanWaitNanos int64
+	if waitSamples := atomic.LoadInt64(&c.stats.waitSamples); waitSamples > 0 {
+		meanWaitNanos = atomic.LoadInt64(&c.stats.totalWaitNanos) / waitSamples
+	}
+
+	return Stats{
+		Flushes:           flushes,
+		TimerFlushes:      timerFlushes,
+		LimitFlushes:      limitFlushes,
+		HandlersCoalesced: atomic.LoadUint64(&c.stats.handlersCoalesced),
+		Rollbacks:         atomic.LoadUint64(&c.stats.rollbacks),
+		LastBatchSize:     int(atomic.LoadInt64(&c.stats.lastBatchSize)),
+		MeanBatchSize:     meanBatchSize,
+		MeanWaitNanos:     meanWaitNanos,
+	}
+}
+
+// recordFlush updates the flush counters for a completed flush of the given
+// kind and invokes Options.OnFlush, if set. kind is flushKindNone for the
+// final drain performed by Close(), which is not recorded at all.
+func (c *Coalescer) recordFlush(kind flushKind, committed int, rollbacks uint64) {
+	if kind == flushKindNone {
+		return
+	}
+	atomic.AddUint64(&c.stats.handlersCoalesced, uint64(committed))
+	atomic.AddUint64(&c.stats.rollbacks, rollbacks)
+	atomic.StoreInt64(&c.stats.lastBatchSize, int64(committed))
+	atomic.AddInt64(&c.stats.totalBatchSize, int64(committed))
+
+	switch kind {
+	case flushKindTimer:
+		atomic.AddUint64(&c.stats.flushes, 1)
+		atomic.AddUint64(&c.stats.timerFlushes, 1)
+	case flushKindLimit:
+		atomic.AddUint64(&c.stats.flushes, 1)
+		atomic.AddUint64(&c.stats.limitFlushes, 1)
+	}
+
+	if kind != flushKindNone && c.opts.OnFlush != nil {
+		c.opts.OnFlush(c.Stats())
+	}
+}
+
+// recordWait updates the mean-wait-time counters for a single Update() or
+// UpdateContext() call.
+func (c *Coalescer) recordWait(d time.Duration) {
+	atomic.AddInt64(&c.stats.totalWaitNanos, int64(d))
+	atomic.AddInt64(&c.stats.waitSamples, 1)
+}
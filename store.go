@@ -0,0 +1,31 @@
+package coalescer
+
+// DB is the minimal interface Coalescer needs from a backing store. It is
+// satisfied by the adapters in the coalescer/boltdb and coalescer/bbolt
+// packages, which wrap boltdb/bolt and go.etcd.io/bbolt respectively.
+type DB interface {
+	Update(fn func(Tx) error) error
+}
+
+// Tx is the minimal set of operations Coalescer's handlers need from a
+// backing store's write transaction.
+type Tx interface {
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	Bucket(name []byte) Bucket
+	DeleteBucket(name []byte) error
+	ForEach(fn func(name []byte, b Bucket) error) error
+}
+
+// Bucket is the minimal set of operations Coalescer's handlers need from a
+// backing store's bucket.
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	Bucket(name []byte) Bucket
+	DeleteBucket(name []byte) error
+	ForEach(fn func(k, v []byte) error) error
+}